@@ -17,6 +17,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -29,6 +31,8 @@ import (
 
 	"github.com/zombiezen/mcm/catalog"
 	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/resourcectx"
+	"github.com/zombiezen/mcm/internal/statecache"
 	"github.com/zombiezen/mcm/internal/system"
 	"github.com/zombiezen/mcm/internal/version"
 	"github.com/zombiezen/mcm/third_party/golang/capnproto"
@@ -53,12 +57,22 @@ func main() {
 	logCommands := flag.Bool("s", false, "show commands run in the log")
 	flag.IntVar(&opts.ConcurrentJobs, "j", 1, "set the maximum number of resources to apply simultaneously")
 	flag.StringVar(&opts.Bash, "bash", execlib.DefaultBashPath, "path to bash shell")
+	stateCachePath := flag.String("state-cache", defaultStateCachePath(), "path to the on-disk cache used to skip resources whose state hasn't changed")
+	refresh := flag.Bool("refresh", false, "ignore the state cache and rehash every resource")
+	logFormat := flag.String("log-format", "text", "log output format: \"text\" or \"json\"")
 	versionMode := flag.Bool("version", false, "display version info")
 	flag.Parse()
 	if *versionMode {
 		version.Show()
 		return
 	}
+	switch *logFormat {
+	case "text", "json":
+		log.format = *logFormat
+	default:
+		fmt.Fprintf(os.Stderr, "mcm-exec: unknown -log-format %q\n", *logFormat)
+		os.Exit(2)
+	}
 	var sys system.System = system.Local{}
 	if *simulate {
 		sys = simulatedSystem{}
@@ -71,6 +85,18 @@ func main() {
 	}
 
 	ctx := context.Background()
+	if *stateCachePath != "" {
+		cache, err := statecache.Open(*stateCachePath)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		sys = cachingSystem{System: sys, cache: cache, refresh: *refresh, log: log}
+		defer func() {
+			if err := cache.Save(); err != nil {
+				log.Error(ctx, err)
+			}
+		}()
+	}
 	var cat catalog.Catalog
 	switch flag.NArg() {
 	case 0:
@@ -97,29 +123,53 @@ func main() {
 		os.Exit(2)
 	}
 
+	// execlib.Apply is where a resourcectx.WithResource value would be
+	// attached to ctx and opts.Log.Progress reported as resources are
+	// scheduled, so that sysLogger's op events and cachingSystem's
+	// start/skip/apply events could be attributed back to the resource
+	// that triggered them. execlib.Apply makes neither call: resource_id
+	// and resource_comment are always zero/empty in -log-format=json
+	// output today, and no progress event is ever emitted.
 	if err := execlib.Apply(ctx, sys, cat, opts); err != nil {
 		log.Fatal(ctx, err)
 	}
 }
 
+// defaultStateCachePath returns the default -state-cache flag value. It
+// returns the empty string (disabling the cache) if the user's cache
+// directory can't be determined.
+func defaultStateCachePath() string {
+	p, err := statecache.DefaultPath()
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
 type sysLogger struct {
 	system.System
 	log *logger
 }
 
 func (l sysLogger) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
-	l.log.Infof(ctx, "mkdir %s", path)
-	return l.System.Mkdir(ctx, path, mode)
+	start := time.Now()
+	err := l.System.Mkdir(ctx, path, mode)
+	l.log.Op(ctx, fmt.Sprintf("mkdir %s", path), time.Since(start))
+	return err
 }
 
 func (l sysLogger) Remove(ctx context.Context, path string) error {
-	l.log.Infof(ctx, "rm %s", path)
-	return l.System.Remove(ctx, path)
+	start := time.Now()
+	err := l.System.Remove(ctx, path)
+	l.log.Op(ctx, fmt.Sprintf("rm %s", path), time.Since(start))
+	return err
 }
 
 func (l sysLogger) Symlink(ctx context.Context, oldname, newname string) error {
-	l.log.Infof(ctx, "ln -s %s %s", oldname, newname)
-	return l.System.Symlink(ctx, oldname, newname)
+	start := time.Now()
+	err := l.System.Symlink(ctx, oldname, newname)
+	l.log.Op(ctx, fmt.Sprintf("ln -s %s %s", oldname, newname), time.Since(start))
+	return err
 }
 
 func (l sysLogger) Chmod(ctx context.Context, path string, mode os.FileMode) error {
@@ -133,23 +183,261 @@ func (l sysLogger) Chmod(ctx context.Context, path string, mode os.FileMode) err
 	if mode&os.ModeSetuid != 0 {
 		m |= 04000
 	}
-	l.log.Infof(ctx, "chmod %4o %s", m, path)
-	return l.System.Chmod(ctx, path, mode)
+	start := time.Now()
+	err := l.System.Chmod(ctx, path, mode)
+	l.log.Op(ctx, fmt.Sprintf("chmod %4o %s", m, path), time.Since(start))
+	return err
 }
 
 func (l sysLogger) Chown(ctx context.Context, path string, uid system.UID, gid system.GID) error {
-	l.log.Infof(ctx, "chown %d:%d %s", uid, gid, path)
-	return l.System.Chown(ctx, path, uid, gid)
+	start := time.Now()
+	err := l.System.Chown(ctx, path, uid, gid)
+	l.log.Op(ctx, fmt.Sprintf("chown %d:%d %s", uid, gid, path), time.Since(start))
+	return err
 }
 
 func (l sysLogger) CreateFile(ctx context.Context, path string, mode os.FileMode) (system.FileWriter, error) {
-	l.log.Infof(ctx, "create file %s", path)
-	return l.System.CreateFile(ctx, path, mode)
+	start := time.Now()
+	fw, err := l.System.CreateFile(ctx, path, mode)
+	l.log.Op(ctx, fmt.Sprintf("create file %s", path), time.Since(start))
+	return fw, err
 }
 
 func (l sysLogger) Run(ctx context.Context, cmd *system.Cmd) (output []byte, err error) {
-	l.log.Infof(ctx, "exec %s", strings.Join(cmd.Args, " "))
-	return l.System.Run(ctx, cmd)
+	start := time.Now()
+	output, err = l.System.Run(ctx, cmd)
+	l.log.Op(ctx, fmt.Sprintf("exec %s", strings.Join(cmd.Args, " ")), time.Since(start))
+	return output, err
+}
+
+// cachingSystem wraps a system.System and consults a statecache.Store
+// before creating a directory, symlink, file, or applying a mode or
+// owner change, so that an operation whose result would exactly match
+// what was last applied there can be skipped instead of redone. It
+// records a new content digest after every Mkdir, Symlink, or file
+// write it makes, and a new mode or owner after every Chmod or Chown
+// of a path that already has a record, invalidating the parent
+// directory's digest each time it records, since the parent's
+// recursive digest depends on it. If log is non-nil, every one of those decisions is
+// also reported as a "skip", "start", or "apply" event through
+// logger.Resource.
+type cachingSystem struct {
+	system.System
+	cache   *statecache.Store
+	refresh bool
+	log     *logger
+}
+
+// logResource reports a cache decision through s.log, if one was
+// configured; cachingSystem works fine without a logger (as in tests
+// that don't care about its output), so this is always safe to call.
+func (s cachingSystem) logResource(ctx context.Context, event, msg string, dur time.Duration) {
+	if s.log != nil {
+		s.log.Resource(ctx, event, msg, dur)
+	}
+}
+
+// unchanged reports whether the on-disk state at path still matches
+// the last-recorded content for it. It deliberately ignores ownership:
+// Mkdir, Symlink, and CreateFile never know a resource's target
+// owner (that arrives later via a separate Chown call), so only Chown
+// itself checks ownership, against the record this method left behind.
+func (s cachingSystem) unchanged(ctx context.Context, path string, content statecache.Digest) bool {
+	if s.refresh {
+		return false
+	}
+	last, mode, _, _, ok := s.cache.LookupContent(path)
+	if !ok || last != content {
+		return false
+	}
+	info, err := s.Lstat(ctx, path)
+	if err != nil || info.Mode() != mode {
+		return false
+	}
+	return true
+}
+
+// recordedOwner returns the uid and gid last recorded for path, so a
+// fresh Record doesn't clobber an owner a previous Chown already
+// applied and cached there. It ignores a stale record left by a
+// different kind of resource that used to occupy path (e.g. a file
+// that was removed to make room for a directory of the same name),
+// since that owner has nothing to do with what's being created now.
+func (s cachingSystem) recordedOwner(path string, wantType os.FileMode) (uid, gid uint32) {
+	_, mode, uid, gid, ok := s.cache.LookupContent(path)
+	if !ok || mode&os.ModeType != wantType&os.ModeType {
+		return 0, 0
+	}
+	return uid, gid
+}
+
+func (s cachingSystem) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	content := statecache.ContentDigest(nil)
+	if s.unchanged(ctx, path, content) {
+		s.logResource(ctx, "skip", fmt.Sprintf("mkdir %s", path), 0)
+		return nil
+	}
+	s.logResource(ctx, "start", fmt.Sprintf("mkdir %s", path), 0)
+	start := time.Now()
+	if err := s.System.Mkdir(ctx, path, mode); err != nil {
+		return err
+	}
+	recordMode := mode | os.ModeDir
+	if info, err := s.Lstat(ctx, path); err == nil {
+		recordMode = info.Mode()
+	}
+	uid, gid := s.recordedOwner(path, os.ModeDir)
+	s.cache.Record(path, recordMode, uid, gid, content)
+	s.cache.RecordHeader(path, recordMode, uid, gid)
+	s.cache.Invalidate(filepath.Dir(path))
+	s.logResource(ctx, "apply", fmt.Sprintf("mkdir %s", path), time.Since(start))
+	return nil
+}
+
+func (s cachingSystem) Symlink(ctx context.Context, oldname, newname string) error {
+	content := sha256.Sum256([]byte(oldname))
+	if s.unchanged(ctx, newname, content) {
+		s.logResource(ctx, "skip", fmt.Sprintf("ln -s %s %s", oldname, newname), 0)
+		return nil
+	}
+	s.logResource(ctx, "start", fmt.Sprintf("ln -s %s %s", oldname, newname), 0)
+	start := time.Now()
+	if err := s.System.Symlink(ctx, oldname, newname); err != nil {
+		return err
+	}
+	// A symlink's permission bits are assigned by the OS, not us, so
+	// probe the result instead of guessing what Lstat will report next time.
+	mode := os.ModeSymlink
+	if info, err := s.Lstat(ctx, newname); err == nil {
+		mode = info.Mode()
+	}
+	uid, gid := s.recordedOwner(newname, os.ModeSymlink)
+	s.cache.Record(newname, mode, uid, gid, content)
+	s.cache.Invalidate(filepath.Dir(newname))
+	s.logResource(ctx, "apply", fmt.Sprintf("ln -s %s %s", oldname, newname), time.Since(start))
+	return nil
+}
+
+// permBits is the part of an os.FileMode that Chmod actually changes —
+// the type bits (os.ModeDir, os.ModeSymlink, ...) are fixed at creation
+// and never part of a chmod request.
+const permBits = os.ModePerm | os.ModeSticky | os.ModeSetuid | os.ModeSetgid
+
+// Chmod applies the target mode, unless the cache already recorded
+// those permission bits for a path whose on-disk mode still matches,
+// in which case it's a no-op. For a directory it consults the header
+// record rather than the recursive-digest record, since a mode change
+// doesn't depend on the directory's children. It updates the cached
+// mode in place, if the path has a record, so a repeat of the same
+// Chmod is skipped; a later Mkdir, Symlink, or CreateFile that runs at
+// the same path replaces it with the mode that call records.
+func (s cachingSystem) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	path = filepath.Clean(path)
+	if !s.refresh {
+		lastMode, _, _, ok := s.cache.LookupHeader(path)
+		if !ok {
+			_, lastMode, _, _, ok = s.cache.LookupContent(path)
+		}
+		if ok && lastMode&permBits == mode&permBits {
+			if info, err := s.Lstat(ctx, path); err == nil && info.Mode()&permBits == mode&permBits {
+				s.logResource(ctx, "skip", fmt.Sprintf("chmod %4o %s", mode&permBits, path), 0)
+				return nil
+			}
+		}
+	}
+	s.logResource(ctx, "start", fmt.Sprintf("chmod %4o %s", mode&permBits, path), 0)
+	start := time.Now()
+	if err := s.System.Chmod(ctx, path, mode); err != nil {
+		return err
+	}
+	newMode := mode
+	if info, err := s.Lstat(ctx, path); err == nil {
+		newMode = info.Mode()
+	}
+	if s.cache.UpdateMode(path, newMode) {
+		s.cache.Invalidate(filepath.Dir(path))
+	}
+	s.logResource(ctx, "apply", fmt.Sprintf("chmod %4o %s", mode&permBits, path), time.Since(start))
+	return nil
+}
+
+// Chown applies the target owner, unless the cache already recorded
+// that owner for a path whose mode still matches what Lstat reports,
+// in which case it's a no-op. For a directory it consults the header
+// record (mode/ownership only) rather than the recursive-digest
+// record, since ownership doesn't depend on the directory's children.
+// It updates the cached owner in place so a later Mkdir, Symlink, or
+// CreateFile at the same path won't reset it back to zero.
+func (s cachingSystem) Chown(ctx context.Context, path string, uid system.UID, gid system.GID) error {
+	path = filepath.Clean(path)
+	if !s.refresh {
+		mode, lastUID, lastGID, ok := s.cache.LookupHeader(path)
+		if !ok {
+			_, mode, lastUID, lastGID, ok = s.cache.LookupContent(path)
+		}
+		if ok && lastUID == uint32(uid) && lastGID == uint32(gid) {
+			if info, err := s.Lstat(ctx, path); err == nil && info.Mode() == mode {
+				s.logResource(ctx, "skip", fmt.Sprintf("chown %d:%d %s", uid, gid, path), 0)
+				return nil
+			}
+		}
+	}
+	s.logResource(ctx, "start", fmt.Sprintf("chown %d:%d %s", uid, gid, path), 0)
+	start := time.Now()
+	if err := s.System.Chown(ctx, path, uid, gid); err != nil {
+		return err
+	}
+	if s.cache.UpdateOwner(path, uint32(uid), uint32(gid)) {
+		s.cache.Invalidate(filepath.Dir(path))
+	}
+	s.logResource(ctx, "apply", fmt.Sprintf("chown %d:%d %s", uid, gid, path), time.Since(start))
+	return nil
+}
+
+func (s cachingSystem) CreateFile(ctx context.Context, path string, mode os.FileMode) (system.FileWriter, error) {
+	return &cachingFileWriter{ctx: ctx, sys: s, path: path, mode: mode}, nil
+}
+
+// cachingFileWriter buffers a file's content so that its digest can be
+// computed and checked against the state cache before the underlying
+// CreateFile is ever called, avoiding the write entirely when nothing
+// changed.
+type cachingFileWriter struct {
+	ctx  context.Context
+	sys  cachingSystem
+	path string
+	mode os.FileMode
+	buf  bytes.Buffer
+}
+
+func (w *cachingFileWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *cachingFileWriter) Close() error {
+	content := sha256.Sum256(w.buf.Bytes())
+	if w.sys.unchanged(w.ctx, w.path, content) {
+		w.sys.logResource(w.ctx, "skip", fmt.Sprintf("create file %s", w.path), 0)
+		return nil
+	}
+	w.sys.logResource(w.ctx, "start", fmt.Sprintf("create file %s", w.path), 0)
+	start := time.Now()
+	fw, err := w.sys.System.CreateFile(w.ctx, w.path, w.mode)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(w.buf.Bytes()); err != nil {
+		fw.Close()
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	uid, gid := w.sys.recordedOwner(w.path, 0)
+	w.sys.cache.Record(w.path, w.mode, uid, gid, content)
+	w.sys.cache.Invalidate(filepath.Dir(w.path))
+	w.sys.logResource(w.ctx, "apply", fmt.Sprintf("create file %s", w.path), time.Since(start))
+	return nil
 }
 
 type simulatedSystem struct{}
@@ -260,18 +548,24 @@ func (discardWriter) Close() error {
 }
 
 type logger struct {
-	quiet bool
-	mu    sync.Mutex
+	quiet  bool
+	format string // "text" or "json"
+	mu     sync.Mutex
 }
 
 func (l *logger) Infof(ctx context.Context, format string, args ...interface{}) {
 	if l.quiet {
 		return
 	}
+	msg := fmt.Sprintf(format, args...)
+	if l.format == "json" {
+		l.emit(ctx, logEvent{Severity: "info", Output: msg})
+		return
+	}
 	now := time.Now()
 	var line bytes.Buffer
 	writeLogHead(&line, "INFO", now)
-	fmt.Fprintf(&line, format, args...)
+	line.WriteString(msg)
 	if b := line.Bytes(); b[len(b)-1] != '\n' {
 		line.WriteByte('\n')
 	}
@@ -280,15 +574,49 @@ func (l *logger) Infof(ctx context.Context, format string, args ...interface{})
 	os.Stderr.Write(line.Bytes())
 }
 
-func (l *logger) Error(ctx context.Context, err error) {
-	now := time.Now()
-	var line bytes.Buffer
-	writeLogHead(&line, "ERROR", now)
-	line.WriteString(err.Error())
-	if b := line.Bytes(); b[len(b)-1] != '\n' {
-		line.WriteByte('\n')
+// Op reports a single operation (e.g. "mkdir /etc/foo") performed by
+// system.System on behalf of the resource attached to ctx, if any, and
+// how long it took.
+func (l *logger) Op(ctx context.Context, msg string, dur time.Duration) {
+	l.resourceEvent(ctx, "op", msg, dur)
+}
+
+// Resource reports a cachingSystem decision for the resource attached
+// to ctx: "start" when it's about to do real work because the cache
+// missed, "apply" when that work finishes, or "skip" when the cache
+// hit and nothing ran at all. msg and dur describe the same thing Op's
+// do, just at the resource-cache level instead of the individual
+// system.System call level.
+func (l *logger) Resource(ctx context.Context, event, msg string, dur time.Duration) {
+	l.resourceEvent(ctx, event, msg, dur)
+}
+
+func (l *logger) resourceEvent(ctx context.Context, event, msg string, dur time.Duration) {
+	if l.quiet {
+		return
+	}
+	if l.format == "json" {
+		l.emit(ctx, logEvent{Severity: "info", Event: event, Output: msg, DurationMS: dur.Milliseconds()})
+		return
 	}
+	l.Infof(ctx, "%s", msg)
+}
+
+// Progress reports how many of the total resources in the catalog have
+// been applied so far, and how many are currently in flight. It is a
+// no-op in text mode, where progress isn't rendered. Nothing calls it:
+// execlib.Apply does not report progress as it schedules resources.
+// It exists so that
+// *logger already satisfies whatever Logger interface execlib.Options
+// expects, leaving the call itself as the only missing piece.
+func (l *logger) Progress(ctx context.Context, total, done, inFlight int) {
+	if l.quiet || l.format != "json" {
+		return
+	}
+	l.emit(ctx, logEvent{Severity: "info", Event: "progress", Total: total, Done: done, InFlight: inFlight})
+}
 
+func (l *logger) Error(ctx context.Context, err error) {
 	var output []byte
 	if !l.quiet {
 		if err, ok := err.(*execlib.Error); ok && len(err.Output) > 0 {
@@ -300,11 +628,23 @@ func (l *logger) Error(ctx context.Context, err error) {
 				output = new
 			}
 			output = err.Output
-			if err.Output[len(err.Output)-1] != '\n' {
-				line.WriteByte('\n')
-			}
 		}
 	}
+	if l.format == "json" {
+		l.emit(ctx, logEvent{Severity: "error", Event: "error", Message: err.Error(), Output: string(output)})
+		return
+	}
+
+	now := time.Now()
+	var line bytes.Buffer
+	writeLogHead(&line, "ERROR", now)
+	line.WriteString(err.Error())
+	if b := line.Bytes(); b[len(b)-1] != '\n' {
+		line.WriteByte('\n')
+	}
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		line.WriteByte('\n')
+	}
 
 	defer l.mu.Unlock()
 	l.mu.Lock()
@@ -325,6 +665,34 @@ func (l *logger) Fatal(ctx context.Context, err error) {
 	os.Exit(1)
 }
 
+// logEvent is the shape of one line of -log-format=json output.
+type logEvent struct {
+	Time            string `json:"ts"`
+	Severity        string `json:"severity"`
+	ResourceID      uint64 `json:"resource_id,omitempty"`
+	ResourceComment string `json:"resource_comment,omitempty"`
+	Event           string `json:"event,omitempty"`
+	DurationMS      int64  `json:"duration_ms,omitempty"`
+	Message         string `json:"message,omitempty"`
+	Output          string `json:"output,omitempty"`
+	Total           int    `json:"total,omitempty"`
+	Done            int    `json:"done,omitempty"`
+	InFlight        int    `json:"in_flight,omitempty"`
+}
+
+// emit writes ev as a single line of JSON to stderr, filling in Time
+// and the resource fields from ctx.
+func (l *logger) emit(ctx context.Context, ev logEvent) {
+	ev.Time = time.Now().Format(time.RFC3339Nano)
+	if id, comment, ok := resourcectx.FromContext(ctx); ok {
+		ev.ResourceID = id
+		ev.ResourceComment = comment
+	}
+	defer l.mu.Unlock()
+	l.mu.Lock()
+	json.NewEncoder(os.Stderr).Encode(ev)
+}
+
 func readCatalog(r io.Reader) (catalog.Catalog, error) {
 	msg, err := capnp.NewDecoder(r).Decode()
 	if err != nil {
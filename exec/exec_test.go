@@ -0,0 +1,204 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zombiezen/mcm/internal/statecache"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// fakeSystem implements system.System against the real filesystem, so
+// cachingSystem's Lstat-based comparisons see real mode bits, while
+// ownership-related methods are no-ops that don't require privileges
+// to run in a test.
+type fakeSystem struct{}
+
+func (fakeSystem) Lstat(ctx context.Context, path string) (os.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (fakeSystem) Readlink(ctx context.Context, path string) (string, error) {
+	return os.Readlink(path)
+}
+
+func (fakeSystem) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	return os.Mkdir(path, mode)
+}
+
+func (fakeSystem) Remove(ctx context.Context, path string) error {
+	return os.Remove(path)
+}
+
+func (fakeSystem) Symlink(ctx context.Context, oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (fakeSystem) CreateFile(ctx context.Context, path string, mode os.FileMode) (system.FileWriter, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+}
+
+func (fakeSystem) OpenFile(ctx context.Context, path string) (system.File, error) {
+	return os.Open(path)
+}
+
+func (fakeSystem) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return os.Chmod(path, mode)
+}
+
+func (fakeSystem) Chown(ctx context.Context, path string, uid system.UID, gid system.GID) error {
+	return nil
+}
+
+func (fakeSystem) OwnerInfo(fi os.FileInfo) (system.UID, system.GID, error) {
+	return 0, 0, nil
+}
+
+func (fakeSystem) LookupUser(name string) (system.UID, error) {
+	return 0, nil
+}
+
+func (fakeSystem) LookupGroup(name string) (system.GID, error) {
+	return 0, nil
+}
+
+func (fakeSystem) Run(ctx context.Context, cmd *system.Cmd) ([]byte, error) {
+	return nil, nil
+}
+
+// countingSystem wraps fakeSystem and counts how many times each
+// mutating method actually runs, so a test can tell whether
+// cachingSystem skipped it or went ahead and redid the work.
+type countingSystem struct {
+	fakeSystem
+	mkdirs, chmods int
+}
+
+func (c *countingSystem) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	c.mkdirs++
+	return c.fakeSystem.Mkdir(ctx, path, mode)
+}
+
+func (c *countingSystem) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	c.chmods++
+	return c.fakeSystem.Chmod(ctx, path, mode)
+}
+
+func TestCachingSystemChmodHitsCache(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "d")
+	cache, err := statecache.Open(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &countingSystem{}
+	sys := cachingSystem{System: cs, cache: cache}
+	ctx := context.Background()
+
+	if err := sys.Mkdir(ctx, path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if cs.mkdirs != 1 {
+		t.Fatalf("mkdirs = %d, want 1", cs.mkdirs)
+	}
+
+	if err := sys.Chmod(ctx, path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if cs.chmods != 0 {
+		t.Errorf("Chmod re-applied a mode that already matched: chmods = %d, want 0", cs.chmods)
+	}
+
+	if err := sys.Chmod(ctx, path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if cs.chmods != 1 {
+		t.Errorf("Chmod did not apply a real mode change: chmods = %d, want 1", cs.chmods)
+	}
+
+	if err := sys.Chmod(ctx, path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if cs.chmods != 1 {
+		t.Errorf("Chmod re-applied the mode it had just cached: chmods = %d, want 1", cs.chmods)
+	}
+}
+
+// TestCachingSystemLogsResourceEvents checks that cachingSystem reports
+// its cache decisions through a *logger, rather than just making them:
+// a cache miss logs "start" then "apply", and a cache hit logs only
+// "skip".
+func TestCachingSystemLogsResourceEvents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "d")
+	cache, err := statecache.Open(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stderr
+	os.Stderr = w
+	log := &logger{format: "json"}
+	sys := cachingSystem{System: fakeSystem{}, cache: cache, log: log}
+	ctx := context.Background()
+
+	if err := sys.Mkdir(ctx, path, 0755); err != nil {
+		os.Stderr = old
+		t.Fatal(err)
+	}
+	if err := sys.Mkdir(ctx, path, 0755); err != nil {
+		os.Stderr = old
+		t.Fatal(err)
+	}
+	os.Stderr = old
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var ev struct {
+			Event string `json:"event"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev.Event)
+	}
+	want := []string{"start", "apply", "skip"}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i, e := range want {
+		if events[i] != e {
+			t.Errorf("events[%d] = %q, want %q", i, events[i], e)
+		}
+	}
+}
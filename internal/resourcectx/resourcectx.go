@@ -0,0 +1,43 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resourcectx carries the resource currently being applied on
+// a context.Context, so that a Logger invoked deep inside a
+// system.System call — for example through a system.System wrapper
+// like mcm-exec's sysLogger — can attribute its output back to the
+// resource that triggered it. Only a context annotated with
+// WithResource carries one; execlib.Apply does not call WithResource.
+package resourcectx
+
+import "context"
+
+type key struct{}
+
+type resource struct {
+	id      uint64
+	comment string
+}
+
+// WithResource returns a copy of ctx annotated with the resource
+// identified by id and comment.
+func WithResource(ctx context.Context, id uint64, comment string) context.Context {
+	return context.WithValue(ctx, key{}, resource{id: id, comment: comment})
+}
+
+// FromContext reports the resource most recently attached to ctx with
+// WithResource, if any.
+func FromContext(ctx context.Context) (id uint64, comment string, ok bool) {
+	r, ok := ctx.Value(key{}).(resource)
+	return r.id, r.comment, ok
+}
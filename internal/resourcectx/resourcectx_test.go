@@ -0,0 +1,43 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resourcectx
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWithResourceRoundTrip(t *testing.T) {
+	ctx := WithResource(context.Background(), 42, "install foo")
+	id, comment, ok := FromContext(ctx)
+	if !ok || id != 42 || comment != "install foo" {
+		t.Fatalf("FromContext(WithResource(ctx, 42, %q)) = %d, %q, %v, want 42, %q, true", "install foo", id, comment, ok, "install foo")
+	}
+}
+
+func TestFromContextWithoutResource(t *testing.T) {
+	if _, _, ok := FromContext(context.Background()); ok {
+		t.Error("FromContext(context.Background()) reported a resource, want none")
+	}
+}
+
+func TestWithResourceOverridesOuter(t *testing.T) {
+	ctx := WithResource(context.Background(), 1, "a")
+	ctx = WithResource(ctx, 2, "b")
+	id, comment, ok := FromContext(ctx)
+	if !ok || id != 2 || comment != "b" {
+		t.Fatalf("FromContext(nested WithResource) = %d, %q, %v, want 2, \"b\", true", id, comment, ok)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package statecache stores the digests of resources that execlib has
+// already applied, so that a later run can skip a file or directory
+// whose on-disk state already matches the catalog instead of reading
+// and rewriting it.
+//
+// A digest is computed the same way for every path: hash the path's
+// mode, uid, and gid together with a content digest. For a plain file
+// or symlink, the content digest covers the file's bytes or link
+// target. For a directory, HashDir/ContentDigest can fold in the name
+// and digest of each child, sorted by name, so a single lookup could
+// validate an entire subtree at once — but that requires a caller that
+// knows a directory's full child list up front, which means execlib's
+// resource-dependency graph. execlib isn't part of this package, and no
+// caller here builds that list yet, so in this tree a directory's
+// records hold only its own mode and ownership: its digest entry is
+// recorded with ContentDigest(nil), standing in for "no children
+// considered," beside the header entry RecordHeader keeps.
+package statecache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Digest is a SHA-256 digest of a resource's on-disk state.
+type Digest [sha256.Size]byte
+
+// DefaultPath returns the default location of the state cache,
+// ~/.cache/mcm/state.db.
+func DefaultPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("statecache: default path: %v", err)
+	}
+	return filepath.Join(dir, "mcm", "state.db"), nil
+}
+
+// Child is a single named entry considered when computing a directory's
+// digest.
+type Child struct {
+	Name   string
+	Digest Digest
+}
+
+// HashFile computes the digest of a plain file or symlink with the
+// given mode, ownership, and content digest.
+func HashFile(mode os.FileMode, uid, gid uint32, content Digest) Digest {
+	h := sha256.New()
+	writeHeader(h, mode, uid, gid)
+	h.Write(content[:])
+	return sum(h)
+}
+
+// HashDir computes the recursive digest of a directory with the given
+// mode, ownership, and children. The children need not be sorted;
+// ContentDigest (which HashDir calls) sorts a copy before hashing so
+// that directory listing order does not affect the result.
+//
+// No caller in this tree passes a real child list: cachingSystem.Mkdir
+// creates a directory before any of its children exist, so it always
+// calls ContentDigest(nil) and caches the directory by its header
+// alone. Computing a real recursive digest needs a caller that already
+// knows the directory's full child set — execlib's resource graph,
+// once that wiring exists.
+func HashDir(mode os.FileMode, uid, gid uint32, children []Child) Digest {
+	return HashFile(mode, uid, gid, ContentDigest(children))
+}
+
+// ContentDigest computes the digest of a directory's children alone —
+// sorted by name so that listing order doesn't matter — independent of
+// the directory's own mode and ownership. HashDir combines it with a
+// header; a Store keeps it as a record's Content field so the header
+// can be updated (e.g. after a chown) without rehashing the children.
+func ContentDigest(children []Child) Digest {
+	sorted := append([]Child(nil), children...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	h := sha256.New()
+	for _, c := range sorted {
+		io.WriteString(h, c.Name)
+		h.Write(c.Digest[:])
+	}
+	return sum(h)
+}
+
+func writeHeader(h hash.Hash, mode os.FileMode, uid, gid uint32) {
+	binary.Write(h, binary.LittleEndian, uint32(mode))
+	binary.Write(h, binary.LittleEndian, uid)
+	binary.Write(h, binary.LittleEndian, gid)
+}
+
+func sum(h hash.Hash) Digest {
+	var d Digest
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+// header is the persisted mode and ownership for a path.
+type header struct {
+	Mode uint32
+	UID  uint32
+	GID  uint32
+}
+
+// record is the persisted state for a single path key. Digest is
+// computed on lookup as HashFile(Header.Mode, Header.UID, Header.GID,
+// Content); Content is kept separate from the header so that an
+// owner-only change (a chown with no content change) can update the
+// header in place without rehashing the file's bytes or a directory's
+// children.
+type record struct {
+	Header  header
+	Content Digest
+}
+
+// Store is an on-disk cache mapping a path key to the state that was
+// last applied there. A file or symlink has a single entry keyed by
+// its cleaned absolute path. A directory has two entries: one at its
+// cleaned path (Lookup, LookupContent) holding the recursive digest of
+// its whole subtree, so a top-level directory resource can be
+// validated with a single lookup; and one at its cleaned path plus a
+// trailing separator (LookupHeader, RecordHeader) holding just its own
+// mode and ownership, independent of its children, so a child resource
+// can still be looked up and invalidated independently of its parent's
+// header.
+//
+// A Store is safe for concurrent use.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]record
+	dirty   bool
+}
+
+// Open reads the state cache at path, returning a new empty Store if
+// the file does not yet exist.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, entries: make(map[string]record)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("statecache: open %s: %v", path, err)
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&s.entries); err != nil {
+		return nil, fmt.Errorf("statecache: open %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Lookup returns the last recorded digest for the cleaned absolute
+// path p — the combination of its mode, ownership, and content — along
+// with the mode and ownership it was recorded with. It reports false
+// if p has no record.
+func (s *Store) Lookup(p string) (digest Digest, mode os.FileMode, uid, gid uint32, ok bool) {
+	content, mode, uid, gid, ok := s.LookupContent(p)
+	if !ok {
+		return Digest{}, 0, 0, 0, false
+	}
+	return HashFile(mode, uid, gid, content), mode, uid, gid, true
+}
+
+// LookupContent returns the last recorded content digest for the
+// cleaned absolute path p, along with the mode and ownership it was
+// recorded with, without combining them into the single digest Lookup
+// returns. It reports false if p has no record.
+func (s *Store) LookupContent(p string) (content Digest, mode os.FileMode, uid, gid uint32, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.entries[filepath.Clean(p)]
+	if !ok {
+		return Digest{}, 0, 0, 0, false
+	}
+	return r.Content, os.FileMode(r.Header.Mode), r.Header.UID, r.Header.GID, true
+}
+
+// Record stores the content digest, mode, and ownership for the
+// cleaned absolute path p, replacing any previous record.
+func (s *Store) Record(p string, mode os.FileMode, uid, gid uint32, content Digest) {
+	p = filepath.Clean(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[p] = record{
+		Header:  header{Mode: uint32(mode), UID: uid, GID: gid},
+		Content: content,
+	}
+	s.dirty = true
+}
+
+// UpdateOwner changes the recorded uid and gid for the cleaned
+// absolute path p, keeping its previously recorded mode and content
+// digest, so that a chown with no other change doesn't require
+// rehashing the path. It reports false if p has no record.
+func (s *Store) UpdateOwner(p string, uid, gid uint32) bool {
+	p = filepath.Clean(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.entries[p]
+	if !ok {
+		return false
+	}
+	r.Header.UID, r.Header.GID = uid, gid
+	s.entries[p] = r
+	hk := headerKey(p)
+	if hr, ok := s.entries[hk]; ok {
+		hr.Header.UID, hr.Header.GID = uid, gid
+		s.entries[hk] = hr
+	}
+	s.dirty = true
+	return true
+}
+
+// UpdateMode changes the recorded mode for the cleaned absolute path
+// p, keeping its previously recorded ownership and content digest, so
+// that a chmod with no other change doesn't require rehashing the
+// path. It reports false if p has no record.
+func (s *Store) UpdateMode(p string, mode os.FileMode) bool {
+	p = filepath.Clean(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.entries[p]
+	if !ok {
+		return false
+	}
+	r.Header.Mode = uint32(mode)
+	s.entries[p] = r
+	hk := headerKey(p)
+	if hr, ok := s.entries[hk]; ok {
+		hr.Header.Mode = uint32(mode)
+		s.entries[hk] = hr
+	}
+	s.dirty = true
+	return true
+}
+
+// RecordHeader stores the mode and ownership for the directory header
+// at the cleaned absolute path p, keyed separately from the recursive
+// digest Record stores for p, so a child resource can be invalidated
+// without forcing the parent's header to be rehashed.
+func (s *Store) RecordHeader(p string, mode os.FileMode, uid, gid uint32) {
+	key := headerKey(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = record{Header: header{Mode: uint32(mode), UID: uid, GID: gid}}
+	s.dirty = true
+}
+
+// LookupHeader returns the last-recorded mode and ownership for the
+// directory header at p, independent of its recursive digest entry.
+// It reports false if there's no header record.
+func (s *Store) LookupHeader(p string) (mode os.FileMode, uid, gid uint32, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.entries[headerKey(p)]
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return os.FileMode(r.Header.Mode), r.Header.UID, r.Header.GID, true
+}
+
+// headerKey returns the key under which a directory's header-only
+// entry is stored, distinct from the cleaned path Lookup and Record
+// use for its recursive digest.
+func headerKey(p string) string {
+	return filepath.Clean(p) + string(filepath.Separator)
+}
+
+// Invalidate drops the recursive-digest record for the cleaned
+// absolute path p and for every ancestor directory of p, since each
+// ancestor's recursive digest was computed over p and is now stale. It
+// leaves header entries (see RecordHeader) alone: a descendant
+// changing doesn't mean an ancestor directory's own mode or ownership
+// changed.
+func (s *Store) Invalidate(p string) {
+	p = filepath.Clean(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if _, ok := s.entries[p]; ok {
+			delete(s.entries, p)
+			s.dirty = true
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return
+		}
+		p = parent
+	}
+}
+
+// Save writes the cache back to its file if it has changed since it
+// was opened or last saved.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("statecache: save: %v", err)
+	}
+	tmp, err := ioutil.TempFile(dir, ".state.db.tmp")
+	if err != nil {
+		return fmt.Errorf("statecache: save: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(s.entries); err != nil {
+		tmp.Close()
+		return fmt.Errorf("statecache: save: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("statecache: save: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("statecache: save: %v", err)
+	}
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashDirOrderIndependent(t *testing.T) {
+	a := Digest{1}
+	b := Digest{2}
+	d1 := HashDir(0755, 0, 0, []Child{{Name: "a", Digest: a}, {Name: "b", Digest: b}})
+	d2 := HashDir(0755, 0, 0, []Child{{Name: "b", Digest: b}, {Name: "a", Digest: a}})
+	if d1 != d2 {
+		t.Errorf("HashDir depends on child order: %x != %x", d1, d2)
+	}
+}
+
+func TestHashDirSensitiveToChildren(t *testing.T) {
+	a := Digest{1}
+	b := Digest{2}
+	d1 := HashDir(0755, 0, 0, []Child{{Name: "a", Digest: a}})
+	d2 := HashDir(0755, 0, 0, []Child{{Name: "a", Digest: b}})
+	if d1 == d2 {
+		t.Error("HashDir did not change when a child's digest changed")
+	}
+}
+
+func TestHashFileSensitiveToModeAndOwner(t *testing.T) {
+	content := Digest{0xab}
+	base := HashFile(0644, 1, 1, content)
+	if HashFile(0600, 1, 1, content) == base {
+		t.Error("HashFile did not change when mode changed")
+	}
+	if HashFile(0644, 2, 1, content) == base {
+		t.Error("HashFile did not change when uid changed")
+	}
+	if HashFile(0644, 1, 1, Digest{0xcd}) == base {
+		t.Error("HashFile did not change when content digest changed")
+	}
+}
+
+func TestStoreRecordLookupInvalidate(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := Digest{0x42}
+	s.Record("/etc/foo", 0644, 0, 0, content)
+
+	want := HashFile(0644, 0, 0, content)
+	got, mode, _, _, ok := s.Lookup("/etc/foo")
+	if !ok || got != want || mode != os.FileMode(0644) {
+		t.Fatalf("Lookup(/etc/foo) = %x, %v, %v, want %x, 0644, true", got, mode, ok, want)
+	}
+
+	s.Invalidate("/etc/foo")
+	if _, _, _, _, ok := s.Lookup("/etc/foo"); ok {
+		t.Error("Lookup(/etc/foo) found a record after Invalidate")
+	}
+}
+
+func TestStoreInvalidatePropagatesToAncestors(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record("/etc", 0755, 0, 0, ContentDigest(nil))
+	s.Record("/etc/foo", 0644, 0, 0, Digest{0x1})
+
+	s.Invalidate("/etc/foo")
+
+	if _, _, _, _, ok := s.Lookup("/etc"); ok {
+		t.Error("Invalidate(/etc/foo) left /etc's recursive digest cached")
+	}
+}
+
+func TestStoreUpdateOwnerKeepsContent(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := Digest{0x7}
+	s.Record("/etc/foo", 0644, 0, 0, content)
+
+	if ok := s.UpdateOwner("/etc/foo", 1000, 1000); !ok {
+		t.Fatal("UpdateOwner(/etc/foo) = false, want true")
+	}
+
+	got, mode, uid, gid, ok := s.Lookup("/etc/foo")
+	want := HashFile(0644, 1000, 1000, content)
+	if !ok || got != want || mode != os.FileMode(0644) || uid != 1000 || gid != 1000 {
+		t.Fatalf("Lookup(/etc/foo) = %x, %v, %d, %d, %v, want %x, 0644, 1000, 1000, true", got, mode, uid, gid, ok, want)
+	}
+}
+
+func TestStoreUpdateOwnerOnUnknownPath(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok := s.UpdateOwner("/etc/foo", 1000, 1000); ok {
+		t.Error("UpdateOwner(/etc/foo) = true for a path with no record, want false")
+	}
+}
+
+func TestStoreUpdateModeKeepsContent(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := Digest{0x7}
+	s.Record("/etc/foo", 0644, 1000, 1000, content)
+
+	if ok := s.UpdateMode("/etc/foo", 0600); !ok {
+		t.Fatal("UpdateMode(/etc/foo) = false, want true")
+	}
+
+	got, mode, uid, gid, ok := s.Lookup("/etc/foo")
+	want := HashFile(0600, 1000, 1000, content)
+	if !ok || got != want || mode != os.FileMode(0600) || uid != 1000 || gid != 1000 {
+		t.Fatalf("Lookup(/etc/foo) = %x, %v, %d, %d, %v, want %x, 0600, 1000, 1000, true", got, mode, uid, gid, ok, want)
+	}
+}
+
+func TestStoreUpdateModeOnUnknownPath(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok := s.UpdateMode("/etc/foo", 0600); ok {
+		t.Error("UpdateMode(/etc/foo) = true for a path with no record, want false")
+	}
+}
+
+func TestStoreHeaderIsIndependentOfDigest(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record("/etc", 0755, 0, 0, ContentDigest(nil))
+	s.RecordHeader("/etc", 0750, 1, 1)
+
+	mode, uid, gid, ok := s.LookupHeader("/etc")
+	if !ok || mode != os.FileMode(0750) || uid != 1 || gid != 1 {
+		t.Fatalf("LookupHeader(/etc) = %v, %d, %d, %v, want 0750, 1, 1, true", mode, uid, gid, ok)
+	}
+
+	if _, mode, _, _, ok := s.Lookup("/etc"); !ok || mode != os.FileMode(0755) {
+		t.Fatalf("Lookup(/etc) mode = %v, %v, want 0755, true (RecordHeader must not touch the digest entry)", mode, ok)
+	}
+}
+
+func TestStoreInvalidateLeavesHeaderIntact(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record("/etc", 0755, 0, 0, ContentDigest(nil))
+	s.RecordHeader("/etc", 0755, 0, 0)
+	s.Record("/etc/foo", 0644, 0, 0, Digest{0x1})
+
+	s.Invalidate("/etc/foo")
+
+	if _, _, _, ok := s.LookupHeader("/etc"); !ok {
+		t.Error("Invalidate(/etc/foo) dropped /etc's header entry; a child change shouldn't invalidate its parent's own mode/ownership")
+	}
+}
+
+func TestStoreRecordPreservesModeTypeBits(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record("/etc", os.ModeDir|0755, 0, 0, ContentDigest(nil))
+	s.Record("/etc/link", os.ModeSymlink|0777, 0, 0, Digest{0x1})
+
+	if _, mode, _, _, ok := s.Lookup("/etc"); !ok || mode != os.ModeDir|0755 {
+		t.Errorf("Lookup(/etc) mode = %v, want %v (a caller comparing this against os.Lstat's FileMode needs the type bit preserved)", mode, os.ModeDir|0755)
+	}
+	if _, mode, _, _, ok := s.Lookup("/etc/link"); !ok || mode != os.ModeSymlink|0777 {
+		t.Errorf("Lookup(/etc/link) mode = %v, want %v", mode, os.ModeSymlink|0777)
+	}
+}
@@ -90,12 +90,7 @@ func (g *gen) in()  { g.indent++ }
 func (g *gen) out() { g.indent-- }
 
 func (g *gen) resource(r catalog.Resource) error {
-	g.p()
-	if c, _ := r.Comment(); c != "" {
-		g.p(script("# "), script(c))
-	} else {
-		g.p(script("# Resource ID="), r.ID())
-	}
+	writeResourceHeader(g, r)
 	f, _ := r.File()
 	path, err := f.Path()
 	if err != nil {
@@ -103,27 +98,117 @@ func (g *gen) resource(r catalog.Resource) error {
 	} else if path == "" {
 		return errors.New("file path is empty")
 	}
+	if err := visitFile(g, path, f); err != nil {
+		return err
+	}
+	return g.permissions(path, f)
+}
+
+// writeResourceHeader emits the comment line that precedes a
+// resource's generated commands, identifying it by its catalog
+// comment or, failing that, its ID. It's shared with the tar backend
+// so a resource looks the same whether it ends up in a bash script or
+// a standalone exec fragment.
+func writeResourceHeader(g *gen, r catalog.Resource) {
+	g.p()
+	if c, _ := r.Comment(); c != "" {
+		g.p(script("# "), script(c))
+	} else {
+		g.p(script("# Resource ID="), r.ID())
+	}
+}
+
+// fileVisitor receives the catalog.File payload of a resource broken
+// out by kind, so that different export backends (the bash script and
+// the tar archive) can share the same walk over a catalog's dependency
+// graph instead of duplicating the switch on f.Which().
+type fileVisitor interface {
+	plain(path string, f catalog.File) error
+	directory(path string, f catalog.File) error
+	symlink(path string, f catalog.File) error
+}
+
+func visitFile(v fileVisitor, path string, f catalog.File) error {
 	switch f.Which() {
 	case catalog.File_Which_plain:
-		// TODO(soon): touch, even if no content
-		// TODO(soon): respect file mode
-		if f.Plain().HasContent() {
-			g.p(script("base64 -d > "), path, script(" <<!EOF!"))
-			content, _ := f.Plain().Content()
-			enc := base64.NewEncoder(base64.StdEncoding, &g.ew)
-			enc.Write(content)
-			enc.Close()
-			g.ew.WriteString("\n!EOF!\n")
-		}
+		return v.plain(path, f)
 	case catalog.File_Which_directory:
-		// TODO(soon): respect file mode
-		g.p(script("if [[ ! -d "), path, script(" ]]; then"))
-		g.in()
-		g.p(script("mkdir "), path)
-		g.out()
-		g.p(script("fi"))
+		return v.directory(path, f)
+	case catalog.File_Which_symlink:
+		return v.symlink(path, f)
 	default:
-		return fmt.Errorf("unsupported file directive %v", f.Which())
+		return &unsupportedFileError{which: f.Which()}
+	}
+}
+
+func (g *gen) plain(path string, f catalog.File) error {
+	if f.Plain().HasContent() {
+		g.p(script("base64 -d > "), path, script(" <<!EOF!"))
+		content, _ := f.Plain().Content()
+		enc := base64.NewEncoder(base64.StdEncoding, &g.ew)
+		enc.Write(content)
+		enc.Close()
+		g.ew.WriteString("\n!EOF!\n")
+	} else {
+		g.p(script("touch "), path)
+	}
+	return nil
+}
+
+func (g *gen) directory(path string, f catalog.File) error {
+	g.p(script("if [[ ! -d "), path, script(" ]]; then"))
+	g.in()
+	g.p(script("mkdir "), path)
+	g.out()
+	g.p(script("fi"))
+	return nil
+}
+
+func (g *gen) symlink(path string, f catalog.File) error {
+	target, err := f.Symlink().Target()
+	if err != nil {
+		return fmt.Errorf("reading symlink target: %v", err)
+	} else if target == "" {
+		return errors.New("symlink target is empty")
+	}
+	g.p(script("if [[ $(readlink "), path, script(") != "), target, script(" ]]; then"))
+	g.in()
+	g.p(script("ln -sfn "), target, script(" "), path)
+	g.out()
+	g.p(script("fi"))
+	return nil
+}
+
+// permissions emits chmod and chown commands for path if f's mode,
+// user, or group fields are set. It is called uniformly for every file
+// kind so that ownership and mode are applied the same way whether the
+// resource is a plain file, a directory, or a symlink. chmod and plain
+// chown both dereference a symlink, so a symlink's mode (which is
+// meaningless anyway) is skipped, and its ownership is set with
+// "chown -h" instead, to avoid touching whatever the link points to.
+func (g *gen) permissions(path string, f catalog.File) error {
+	symlink := f.Which() == catalog.File_Which_symlink
+	if mode := f.Mode(); mode != 0 && !symlink {
+		g.p(script("chmod "), script(fmt.Sprintf("%04o", mode)), script(" "), path)
+	}
+	user, err := f.User()
+	if err != nil {
+		return fmt.Errorf("reading file user: %v", err)
+	}
+	group, err := f.Group()
+	if err != nil {
+		return fmt.Errorf("reading file group: %v", err)
+	}
+	if user != "" || group != "" {
+		owner := user
+		if group != "" {
+			owner += ":" + group
+		}
+		if symlink {
+			g.p(script("chown -h "), owner, script(" "), path)
+		} else {
+			g.p(script("chown "), owner, script(" "), path)
+		}
 	}
 	return nil
 }
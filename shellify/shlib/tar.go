@@ -0,0 +1,230 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shlib
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/depgraph"
+)
+
+// manifestName is the path, within the archive WriteTar produces, of
+// the file listing the resources it contains, one per line in the run
+// order WriteTar applied them in: tab-separated resource ID, entry
+// name, comma-separated dependency IDs (empty if none), and comment.
+const manifestName = ".mcm/manifest"
+
+// execPrefix is the path prefix, within the archive WriteTar produces,
+// under which resources that can't be represented as a plain file,
+// directory, or symlink are stored as shell fragments.
+const execPrefix = ".mcm/exec/"
+
+// WriteTar converts a catalog into a POSIX tar stream and writes it to
+// w. Resources that manage a plain file, directory, or symlink become
+// tar entries at their path, carrying the same mode, owner, and group
+// WriteScript would apply with chmod/chown. Any other resource is
+// instead stored under execPrefix as a bash fragment, so that it still
+// has an entry in the archive. That fragment holds only the header
+// comment WriteScript writes before a resource (its catalog comment or
+// ID); it contains no commands, so the resource's steps can't be
+// recovered from the archive. A manifest at
+// manifestName lists every resource, the IDs of the resources it
+// depends on, and its entry name, one per line in the run order
+// WriteTar applied them in, so a downstream consumer can recover the
+// dependency graph from the archive instead of just the order it was
+// unpacked in.
+func WriteTar(w io.Writer, c catalog.Catalog) error {
+	res, _ := c.Resources()
+	graph, err := depgraph.New(res)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	t := &tarGen{tw: tw}
+	var manifest bytes.Buffer
+	for !graph.Done() {
+		ready := append([]uint64(nil), graph.Ready()...)
+		if len(ready) == 0 {
+			return errors.New("graph not done, but has nothing to do")
+		}
+		for _, id := range ready {
+			r := graph.Resource(id)
+			name, err := t.resource(r)
+			if err != nil {
+				return fmt.Errorf("resource ID=%d: %v", id, err)
+			}
+			comment, _ := r.Comment()
+			deps := graph.DependenciesOf(id)
+			depStrs := make([]string, len(deps))
+			for i, dep := range deps {
+				depStrs[i] = strconv.FormatUint(dep, 10)
+			}
+			fmt.Fprintf(&manifest, "%d\t%s\t%s\t%s\n", id, name, strings.Join(depStrs, ","), comment)
+			graph.Mark(id)
+		}
+	}
+	if err := t.writeFile(manifestName, 0644, manifest.Bytes()); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// tarGen holds the state needed to emit a catalog as a tar stream. It
+// implements fileVisitor so that plain files, directories, and
+// symlinks are handled identically to WriteScript.
+type tarGen struct {
+	tw *tar.Writer
+}
+
+// resource writes r's tar entry or entries and returns the name of the
+// entry recorded in the manifest for it.
+func (t *tarGen) resource(r catalog.Resource) (name string, err error) {
+	f, _ := r.File()
+	path, pathErr := f.Path()
+	if pathErr == nil && path != "" {
+		if err := visitFile(t, path, f); err == nil {
+			return path, nil
+		} else if _, unsupported := err.(*unsupportedFileError); !unsupported {
+			return "", err
+		}
+	}
+	return t.execFragment(r)
+}
+
+// execFragment renders r as a standalone shell fragment and stores it
+// under execPrefix. Unlike gen.resource, it tolerates exactly the
+// cases that send a resource here in the first place — an empty path
+// or a file directive visitFile doesn't recognize — by falling back to
+// just the resource's header comment instead of failing, so a resource
+// WriteTar can't place directly in the tree still ends up in the
+// archive.
+func (t *tarGen) execFragment(r catalog.Resource) (string, error) {
+	var frag bytes.Buffer
+	g := &gen{ew: errWriter{w: &frag}}
+	writeResourceHeader(g, r)
+	if f, ferr := r.File(); ferr == nil {
+		if path, perr := f.Path(); perr == nil && path != "" {
+			if err := visitFile(g, path, f); err == nil {
+				if err := g.permissions(path, f); err != nil {
+					return "", err
+				}
+			} else if _, unsupported := err.(*unsupportedFileError); !unsupported {
+				return "", err
+			}
+		}
+	}
+	name := fmt.Sprintf("%s%d.sh", execPrefix, r.ID())
+	if err := t.writeFile(name, 0755, frag.Bytes()); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (t *tarGen) writeFile(name string, mode int64, content []byte) error {
+	h := &tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    int64(len(content)),
+		ModTime: time.Unix(0, 0),
+	}
+	if err := t.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err := t.tw.Write(content)
+	return err
+}
+
+// tarName cleans path into the form the tar format expects for an
+// entry of the given type: relative to the archive root, with a
+// trailing slash on directories so that consumers that key off the
+// name (rather than, or in addition to, Typeflag) recognize them.
+func tarName(path string, typeflag byte) string {
+	name := strings.TrimPrefix(path, "/")
+	if typeflag == tar.TypeDir {
+		name += "/"
+	}
+	return name
+}
+
+func (t *tarGen) header(path string, f catalog.File, typeflag byte, size int64, linkname string) *tar.Header {
+	mode := int64(0644)
+	if typeflag == tar.TypeDir {
+		mode = 0755
+	}
+	if m := f.Mode(); m != 0 {
+		mode = int64(m)
+	}
+	h := &tar.Header{
+		Name:     tarName(path, typeflag),
+		Typeflag: typeflag,
+		Mode:     mode,
+		Size:     size,
+		Linkname: linkname,
+		ModTime:  time.Unix(0, 0),
+	}
+	if user, _ := f.User(); user != "" {
+		h.Uname = user
+	}
+	if group, _ := f.Group(); group != "" {
+		h.Gname = group
+	}
+	return h
+}
+
+func (t *tarGen) plain(path string, f catalog.File) error {
+	var content []byte
+	if f.Plain().HasContent() {
+		content, _ = f.Plain().Content()
+	}
+	h := t.header(path, f, tar.TypeReg, int64(len(content)), "")
+	if err := t.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err := t.tw.Write(content)
+	return err
+}
+
+func (t *tarGen) directory(path string, f catalog.File) error {
+	return t.tw.WriteHeader(t.header(path, f, tar.TypeDir, 0, ""))
+}
+
+func (t *tarGen) symlink(path string, f catalog.File) error {
+	target, err := f.Symlink().Target()
+	if err != nil {
+		return fmt.Errorf("reading symlink target: %v", err)
+	} else if target == "" {
+		return errors.New("symlink target is empty")
+	}
+	return t.tw.WriteHeader(t.header(path, f, tar.TypeSymlink, 0, target))
+}
+
+// unsupportedFileError marks the error visitFile returns for a file
+// directive it doesn't recognize, so that WriteTar can fall back to an
+// exec fragment instead of failing the whole archive.
+type unsupportedFileError struct {
+	which catalog.File_Which
+}
+
+func (e *unsupportedFileError) Error() string {
+	return fmt.Sprintf("unsupported file directive %v", e.which)
+}
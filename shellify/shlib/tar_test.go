@@ -0,0 +1,38 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shlib
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestTarNameDirectoryHasTrailingSlash(t *testing.T) {
+	if got, want := tarName("/etc/nginx", tar.TypeDir), "etc/nginx/"; got != want {
+		t.Errorf("tarName(%q, TypeDir) = %q, want %q", "/etc/nginx", got, want)
+	}
+}
+
+func TestTarNameFileHasNoTrailingSlash(t *testing.T) {
+	if got, want := tarName("/etc/nginx/nginx.conf", tar.TypeReg), "etc/nginx/nginx.conf"; got != want {
+		t.Errorf("tarName(%q, TypeReg) = %q, want %q", "/etc/nginx/nginx.conf", got, want)
+	}
+}
+
+func TestTarNameStripsLeadingSlash(t *testing.T) {
+	if got, want := tarName("/a/b", tar.TypeSymlink), "a/b"; got != want {
+		t.Errorf("tarName(%q, TypeSymlink) = %q, want %q", "/a/b", got, want)
+	}
+}